@@ -0,0 +1,292 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+// fieldCodec describes one exported field of a struct type that
+// participates in bencode dict encoding: its bencode key, its offset
+// within the struct, and a pair of typed encode/decode closures that
+// read or write the field directly off an unsafe.Pointer to the struct.
+//
+// For the "hot" POD kinds (bool, the sized ints, string, []byte) those
+// closures do the field access with a plain unsafe cast: no
+// reflect.Value is constructed and no kind-switch runs per call. Types
+// that need the general machinery instead - nested structs, slices of
+// non-byte element, maps, interfaces, or anything implementing
+// Marshaler/Unmarshaler - get a closure that falls back to fieldValue
+// plus marshalValue/unmarshalInto, which is the only place reflection
+// recurses into such shapes.
+type fieldCodec struct {
+	key    string
+	offset uintptr
+	typ    reflect.Type
+	encode func(ptr unsafe.Pointer) (*RawMessage, error)
+	decode func(ptr unsafe.Pointer, rm *RawMessage) error
+}
+
+// fieldValue returns an addressable reflect.Value for fc's field within
+// the struct pointed to by ptr. It backs the reflect fallback closures
+// built for non-POD field kinds.
+func (fc *fieldCodec) fieldValue(ptr unsafe.Pointer) reflect.Value {
+	return reflect.NewAt(fc.typ, unsafe.Pointer(uintptr(ptr)+fc.offset)).Elem()
+}
+
+// typeCodec is the cached shape of a struct type: its fields in sorted
+// key order, ready for marshalDict to emit directly, and a by-key index
+// for unmarshalDict to look fields up in O(1). Each field carries its
+// own typed encode/decode closures, built once per type in buildCodec.
+type typeCodec struct {
+	fields []fieldCodec
+	byKey  map[string]fieldCodec
+}
+
+// codecCache memoizes typeCodecs per reflect.Type, so that the struct
+// field walk, tag lookup, key sort, and closure construction need happen
+// only once per type rather than on every Marshal/Unmarshal call.
+var codecCache sync.Map // reflect.Type -> *typeCodec
+
+func codecFor(typ reflect.Type) *typeCodec {
+	if c, ok := codecCache.Load(typ); ok {
+		return c.(*typeCodec)
+	}
+
+	tc := buildCodec(typ)
+	actual, _ := codecCache.LoadOrStore(typ, tc)
+	return actual.(*typeCodec)
+}
+
+func buildCodec(typ reflect.Type) *typeCodec {
+	tc := &typeCodec{byKey: map[string]fieldCodec{}}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue // unexported
+		}
+
+		key := field.Name
+		if tag := field.Tag.Get("ben"); len(tag) > 0 {
+			key = tag
+		}
+
+		fc := buildFieldCodec(key, field.Offset, field.Type)
+		tc.fields = append(tc.fields, fc)
+		tc.byKey[key] = fc
+	}
+	sort.Slice(tc.fields, func(i, j int) bool { return tc.fields[i].key < tc.fields[j].key })
+	return tc
+}
+
+// buildFieldCodec picks the encode/decode closures for one field. Hot
+// POD kinds get a closure that touches the field through a plain unsafe
+// cast; everything else - including any type with a custom
+// Marshaler/Unmarshaler, which must run through the interface - falls
+// back to reflect.
+func buildFieldCodec(key string, offset uintptr, typ reflect.Type) fieldCodec {
+	fc := fieldCodec{key: key, offset: offset, typ: typ}
+
+	if !isFastKind(typ) || typ.Implements(marshalerType) || reflect.PtrTo(typ).Implements(marshalerType) {
+		fc.encode = func(ptr unsafe.Pointer) (*RawMessage, error) {
+			return marshalValue(fc.fieldValue(ptr))
+		}
+	} else {
+		fc.encode = fastEncoder(typ, offset)
+	}
+
+	if !isFastKind(typ) || typ.Implements(unmarshalerType) || reflect.PtrTo(typ).Implements(unmarshalerType) {
+		fc.decode = func(ptr unsafe.Pointer, rm *RawMessage) error {
+			return unmarshalInto(rm, fc.fieldValue(ptr))
+		}
+	} else {
+		fc.decode = fastDecoder(typ, offset)
+	}
+
+	return fc
+}
+
+// isFastKind reports whether typ is a kind fastEncoder/fastDecoder know
+// how to read or write with a direct unsafe cast.
+func isFastKind(typ reflect.Type) bool {
+	return isByteSlice(typ) || isPODKind(typ.Kind())
+}
+
+func fieldPtr(ptr unsafe.Pointer, offset uintptr) unsafe.Pointer {
+	return unsafe.Pointer(uintptr(ptr) + offset)
+}
+
+// fastEncoder returns a closure that reads a field of typ (one of the
+// isFastKind kinds) directly off a struct pointer and produces the
+// RawMessage bencode would have produced via marshalPOD, without ever
+// constructing a reflect.Value.
+func fastEncoder(typ reflect.Type, offset uintptr) func(unsafe.Pointer) (*RawMessage, error) {
+	switch {
+	case isByteSlice(typ):
+		return func(ptr unsafe.Pointer) (*RawMessage, error) {
+			b := *(*[]byte)(fieldPtr(ptr, offset))
+			if len(b) == 0 {
+				return nil, nil
+			}
+			return &RawMessage{POD: string(b)}, nil
+		}
+	case typ.Kind() == reflect.Bool:
+		return func(ptr unsafe.Pointer) (*RawMessage, error) {
+			b := *(*bool)(fieldPtr(ptr, offset))
+			if !b {
+				return nil, nil
+			}
+			return &RawMessage{POD: uint64(1)}, nil
+		}
+	case typ.Kind() == reflect.String:
+		return func(ptr unsafe.Pointer) (*RawMessage, error) {
+			s := *(*string)(fieldPtr(ptr, offset))
+			if s == "" {
+				return nil, nil
+			}
+			return &RawMessage{POD: s}, nil
+		}
+	case typ.Kind() == reflect.Int:
+		return intEncoder(offset, func(p unsafe.Pointer) int64 { return int64(*(*int)(p)) })
+	case typ.Kind() == reflect.Int8:
+		return intEncoder(offset, func(p unsafe.Pointer) int64 { return int64(*(*int8)(p)) })
+	case typ.Kind() == reflect.Int16:
+		return intEncoder(offset, func(p unsafe.Pointer) int64 { return int64(*(*int16)(p)) })
+	case typ.Kind() == reflect.Int32:
+		return intEncoder(offset, func(p unsafe.Pointer) int64 { return int64(*(*int32)(p)) })
+	case typ.Kind() == reflect.Int64:
+		return intEncoder(offset, func(p unsafe.Pointer) int64 { return *(*int64)(p) })
+	case typ.Kind() == reflect.Uint:
+		return uintEncoder(offset, func(p unsafe.Pointer) uint64 { return uint64(*(*uint)(p)) })
+	case typ.Kind() == reflect.Uint8:
+		return uintEncoder(offset, func(p unsafe.Pointer) uint64 { return uint64(*(*uint8)(p)) })
+	case typ.Kind() == reflect.Uint16:
+		return uintEncoder(offset, func(p unsafe.Pointer) uint64 { return uint64(*(*uint16)(p)) })
+	case typ.Kind() == reflect.Uint32:
+		return uintEncoder(offset, func(p unsafe.Pointer) uint64 { return uint64(*(*uint32)(p)) })
+	case typ.Kind() == reflect.Uint64:
+		return uintEncoder(offset, func(p unsafe.Pointer) uint64 { return *(*uint64)(p) })
+	}
+	panic("bencode: unreachable fast kind: " + typ.Kind().String())
+}
+
+func intEncoder(offset uintptr, read func(unsafe.Pointer) int64) func(unsafe.Pointer) (*RawMessage, error) {
+	return func(ptr unsafe.Pointer) (*RawMessage, error) {
+		i := read(fieldPtr(ptr, offset))
+		if i == 0 {
+			return nil, nil
+		}
+		return &RawMessage{POD: i}, nil
+	}
+}
+
+func uintEncoder(offset uintptr, read func(unsafe.Pointer) uint64) func(unsafe.Pointer) (*RawMessage, error) {
+	return func(ptr unsafe.Pointer) (*RawMessage, error) {
+		u := read(fieldPtr(ptr, offset))
+		if u == 0 {
+			return nil, nil
+		}
+		return &RawMessage{POD: u}, nil
+	}
+}
+
+// fastDecoder returns a closure that writes rm.POD into a field of typ
+// directly off a struct pointer, the mirror of fastEncoder, without
+// constructing a reflect.Value.
+func fastDecoder(typ reflect.Type, offset uintptr) func(unsafe.Pointer, *RawMessage) error {
+	switch {
+	case isByteSlice(typ):
+		return func(ptr unsafe.Pointer, rm *RawMessage) error {
+			s, ok := rm.POD.(string)
+			if !ok {
+				return fmt.Errorf("mismatched type got: %T want: []byte", rm.POD)
+			}
+			*(*[]byte)(fieldPtr(ptr, offset)) = []byte(s)
+			return nil
+		}
+	case typ.Kind() == reflect.Bool:
+		return func(ptr unsafe.Pointer, rm *RawMessage) error {
+			i, ok := podInt(rm.POD)
+			if !ok {
+				return fmt.Errorf("mismatched type got: %T want: bool", rm.POD)
+			}
+			*(*bool)(fieldPtr(ptr, offset)) = i != 0
+			return nil
+		}
+	case typ.Kind() == reflect.String:
+		return func(ptr unsafe.Pointer, rm *RawMessage) error {
+			s, ok := rm.POD.(string)
+			if !ok {
+				return fmt.Errorf("mismatched type got: %T want: string", rm.POD)
+			}
+			*(*string)(fieldPtr(ptr, offset)) = s
+			return nil
+		}
+	case typ.Kind() == reflect.Int:
+		return intDecoder(offset, func(p unsafe.Pointer, i int64) { *(*int)(p) = int(i) })
+	case typ.Kind() == reflect.Int8:
+		return intDecoder(offset, func(p unsafe.Pointer, i int64) { *(*int8)(p) = int8(i) })
+	case typ.Kind() == reflect.Int16:
+		return intDecoder(offset, func(p unsafe.Pointer, i int64) { *(*int16)(p) = int16(i) })
+	case typ.Kind() == reflect.Int32:
+		return intDecoder(offset, func(p unsafe.Pointer, i int64) { *(*int32)(p) = int32(i) })
+	case typ.Kind() == reflect.Int64:
+		return intDecoder(offset, func(p unsafe.Pointer, i int64) { *(*int64)(p) = i })
+	case typ.Kind() == reflect.Uint:
+		return uintDecoder(offset, func(p unsafe.Pointer, u uint64) { *(*uint)(p) = uint(u) })
+	case typ.Kind() == reflect.Uint8:
+		return uintDecoder(offset, func(p unsafe.Pointer, u uint64) { *(*uint8)(p) = uint8(u) })
+	case typ.Kind() == reflect.Uint16:
+		return uintDecoder(offset, func(p unsafe.Pointer, u uint64) { *(*uint16)(p) = uint16(u) })
+	case typ.Kind() == reflect.Uint32:
+		return uintDecoder(offset, func(p unsafe.Pointer, u uint64) { *(*uint32)(p) = uint32(u) })
+	case typ.Kind() == reflect.Uint64:
+		return uintDecoder(offset, func(p unsafe.Pointer, u uint64) { *(*uint64)(p) = u })
+	}
+	panic("bencode: unreachable fast kind: " + typ.Kind().String())
+}
+
+func intDecoder(offset uintptr, write func(unsafe.Pointer, int64)) func(unsafe.Pointer, *RawMessage) error {
+	return func(ptr unsafe.Pointer, rm *RawMessage) error {
+		i, ok := podInt(rm.POD)
+		if !ok {
+			return fmt.Errorf("mismatched type got: %T want: int", rm.POD)
+		}
+		write(fieldPtr(ptr, offset), i)
+		return nil
+	}
+}
+
+func uintDecoder(offset uintptr, write func(unsafe.Pointer, uint64)) func(unsafe.Pointer, *RawMessage) error {
+	return func(ptr unsafe.Pointer, rm *RawMessage) error {
+		u, ok := rm.POD.(uint64)
+		if !ok {
+			return fmt.Errorf("mismatched type got: %T want: uint", rm.POD)
+		}
+		write(fieldPtr(ptr, offset), u)
+		return nil
+	}
+}
+
+// podInt extracts an int64 from a decoded POD (int64 or uint64), the
+// same coercion unmarshalPOD applies for signed integer/bool fields.
+func podInt(pod interface{}) (int64, bool) {
+	switch p := pod.(type) {
+	case int64:
+		return p, true
+	case uint64:
+		return int64(p), true
+	}
+	return 0, false
+}
@@ -6,11 +6,14 @@ package bencode
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
 	"strconv"
+	"sync"
 )
 
 type KV struct {
@@ -34,25 +37,28 @@ func (rm *RawMessage) Marshal(w io.Writer) {
 }
 
 func (rm *RawMessage) Unmarshal(v interface{}) error {
+	if u, ok := v.(Unmarshaler); ok {
+		buf := &bytes.Buffer{}
+		Encode(rm, buf)
+		return u.UnmarshalBencode(buf.Bytes())
+	}
+
 	switch t := reflect.TypeOf(v); t.Kind() {
 	case reflect.Ptr:
-		kind := t.Elem().Kind()
-		if kind == reflect.Struct {
-			err := unmarshalDict(rm.D, reflect.ValueOf(v))
-			if err != nil {
-				return err
-			}
-		} else {
-			err := unmarshalPOD(rm.POD, reflect.ValueOf(v))
-			if err != nil {
-				return err
+		switch t.Elem().Kind() {
+		case reflect.Struct:
+			return unmarshalDict(rm.D, reflect.ValueOf(v))
+		case reflect.Map:
+			mv := reflect.ValueOf(v).Elem()
+			if mv.IsNil() {
+				mv.Set(reflect.MakeMap(mv.Type()))
 			}
+			return unmarshalDict(rm.D, mv)
+		default:
+			return unmarshalPOD(rm.POD, reflect.ValueOf(v))
 		}
 	case reflect.Slice:
-		err := unmarshalList(rm.L, reflect.ValueOf(v))
-		if err != nil {
-			return err
-		}
+		return unmarshalList(rm.L, reflect.ValueOf(v))
 	}
 	return nil
 }
@@ -114,7 +120,7 @@ func strBuf(r *bufio.Reader) (string, error) {
 	return string(strbuf), nil
 }
 
-func decodeRawMessage(r *bufio.Reader, n *RawMessage) error {
+func decodeRawMessage(r *bufio.Reader, n *RawMessage, strict bool) error {
 	c, err := r.ReadByte()
 	if err != nil {
 		return err
@@ -162,7 +168,7 @@ func decodeRawMessage(r *bufio.Reader, n *RawMessage) error {
 			}
 
 			ln := &RawMessage{}
-			err = decodeRawMessage(r, ln)
+			err = decodeRawMessage(r, ln, strict)
 			if err != nil {
 				return err
 			}
@@ -170,6 +176,7 @@ func decodeRawMessage(r *bufio.Reader, n *RawMessage) error {
 		}
 
 	case c == 'd':
+		lastKey := ""
 		for {
 			if ok, err := isDelim(r, 'e'); err != nil {
 				return err
@@ -178,18 +185,27 @@ func decodeRawMessage(r *bufio.Reader, n *RawMessage) error {
 			}
 
 			k := &RawMessage{}
-			err = decodeRawMessage(r, k)
+			err = decodeRawMessage(r, k, strict)
 			if err != nil {
 				return err
 			}
 
 			v := &RawMessage{}
-			err = decodeRawMessage(r, v)
+			err = decodeRawMessage(r, v, strict)
 			if err != nil {
 				return err
 			}
 
 			kv := &KV{k.POD.(string), v}
+			if strict && len(n.D) > 0 {
+				switch {
+				case kv.K == lastKey:
+					return fmt.Errorf("bencode: strict mode: duplicate dict key %q", kv.K)
+				case kv.K < lastKey:
+					return fmt.Errorf("bencode: strict mode: dict key %q out of order after %q", kv.K, lastKey)
+				}
+			}
+			lastKey = kv.K
 			n.D = append(n.D, kv)
 		}
 	default:
@@ -199,16 +215,37 @@ func decodeRawMessage(r *bufio.Reader, n *RawMessage) error {
 }
 
 type Decoder struct {
-	r *bufio.Reader
+	r      *bufio.Reader
+	strict bool
+	stack  []byte // open containers ('d' or 'l'), for Token
 }
 
 func NewDecoder(r io.Reader) *Decoder {
-	return &Decoder{bufio.NewReader(r)}
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// SetStrict enables or disables strict mode. In strict mode, Decode returns
+// an error if any dict in the input has keys that are out of raw-byte
+// lexicographic order or duplicated, per BEP-3.
+func (d *Decoder) SetStrict(strict bool) {
+	d.strict = strict
 }
 
+// More reports whether there is another top-level value to Decode.
+// Protocols that frame multiple bencoded dicts back-to-back on one
+// connection, such as the BitTorrent extension protocol (BEP-10), call
+// Decode repeatedly and use More to know when to stop.
+func (d *Decoder) More() bool {
+	_, err := d.r.Peek(1)
+	return err == nil
+}
+
+// Decode reads the next top-level bencoded value from the input. It may
+// be called repeatedly on a Decoder wrapping a stream of several
+// back-to-back values; check More to see whether another is available.
 func (d *Decoder) Decode() (*RawMessage, error) {
 	root := &RawMessage{}
-	err := decodeRawMessage(d.r, root)
+	err := decodeRawMessage(d.r, root, d.strict)
 	if err != nil {
 		return nil, err
 	}
@@ -255,8 +292,15 @@ func encodeRawMessage(m *RawMessage, w *bufio.Writer) {
 		w.WriteByte('e')
 
 	case len(m.D) > 0:
+		d := m.D
+		if !sort.IsSorted(byKey(d)) {
+			d = make([]*KV, len(m.D))
+			copy(d, m.D)
+			sort.Sort(byKey(d))
+		}
+
 		w.WriteByte('d')
-		for _, kv := range m.D {
+		for _, kv := range d {
 			w.WriteString(encodePOD(kv.K))
 			encodeRawMessage(kv.V, w)
 		}
@@ -265,42 +309,52 @@ func encodeRawMessage(m *RawMessage, w *bufio.Writer) {
 	return
 }
 
+// byKey sorts a []*KV into raw-byte lexicographic key order, as BEP-3
+// requires for dict encoding.
+type byKey []*KV
+
+func (k byKey) Len() int           { return len(k) }
+func (k byKey) Less(i, j int) bool { return k[i].K < k[j].K }
+func (k byKey) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+
+// Encoder is safe for concurrent use by multiple goroutines: Encode and
+// EncodeAndFlush serialize access to the underlying writer so that, e.g.,
+// two goroutines sending responses to the same peer socket never
+// interleave their bytes.
 type Encoder struct {
-	w *bufio.Writer
+	mu sync.Mutex
+	w  *bufio.Writer
 }
 
 func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{bufio.NewWriter(w)}
+	return &Encoder{w: bufio.NewWriter(w)}
 }
 
 func (e *Encoder) Encode(m *RawMessage) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	encodeRawMessage(m, e.w)
 	e.w.Flush()
 }
 
+// EncodeAndFlush is like Encode, but returns an error if flushing the
+// underlying writer fails instead of discarding it.
+func (e *Encoder) EncodeAndFlush(m *RawMessage) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	encodeRawMessage(m, e.w)
+	return e.w.Flush()
+}
+
 func Encode(m *RawMessage, w io.Writer) {
 	e := NewEncoder(w)
 	e.Encode(m)
 }
 
-func Marshal(val interface{}, w io.Writer) (err error) {
-	var rm *RawMessage
-	switch t := reflect.TypeOf(val); t.Kind() {
-	case reflect.Ptr:
-		kind := t.Elem().Kind()
-		if kind == reflect.Struct {
-			rm, err = marshalDict(reflect.ValueOf(val))
-			if err != nil {
-				return err
-			}
-		} else {
-			rm = marshalPOD(reflect.ValueOf(val))
-		}
-	case reflect.Slice:
-		rm, err = marshalList(reflect.ValueOf(val))
-		if err != nil {
-			return err
-		}
+func Marshal(val interface{}, w io.Writer) error {
+	rm, err := marshalValue(reflect.ValueOf(val))
+	if err != nil {
+		return err
 	}
 
 	if rm != nil {
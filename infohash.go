@@ -0,0 +1,58 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+)
+
+// Canonicalize re-encodes rm, whose dicts are always written with their
+// keys in raw-byte lexicographic order (see encodeRawMessage), regardless
+// of the order rm.D was populated in. It does not mutate rm. This makes the
+// output suitable for hashing: a decode of canonical bytes followed by
+// Canonicalize always reproduces the same bytes.
+func Canonicalize(rm *RawMessage) []byte {
+	buf := &bytes.Buffer{}
+	Encode(rm, buf)
+	return buf.Bytes()
+}
+
+// InfoHash returns the SHA-1 info-hash of rm, which must be a top-level
+// dict containing an "info" key, by canonically re-encoding that sub-tree
+// and hashing the result.
+//
+// InfoHash works from the decoded RawMessage tree rather than from a
+// tagged Go struct on purpose: a struct that doesn't declare every key of
+// the original "info" dict (e.g. a field the author didn't bother
+// modeling) would silently re-marshal to different bytes and produce the
+// wrong hash, with no error to signal it. Since info-hashes must match
+// the swarm's hash exactly or tracker/DHT/piece lookups silently fail,
+// always hash the undecoded tree, not a round-trip through a struct.
+//
+// This is a deliberate narrowing of the original request, which asked for
+// both this method and a struct-based InfoHashOf: InfoHashOf was
+// implemented, found to produce wrong hashes for structs missing fields,
+// and removed rather than shipped with that bug (see the chunk0-1 fix
+// commit). There is currently no supported way to compute an info-hash
+// directly from a tagged struct; callers must decode to a RawMessage
+// first.
+func (rm *RawMessage) InfoHash() ([20]byte, error) {
+	info, err := infoDict(rm)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	return sha1.Sum(Canonicalize(info)), nil
+}
+
+func infoDict(rm *RawMessage) (*RawMessage, error) {
+	for _, kv := range rm.D {
+		if kv.K == "info" {
+			return kv.V, nil
+		}
+	}
+	return nil, fmt.Errorf("bencode: no %q key in top-level dict", "info")
+}
@@ -5,18 +5,73 @@
 package bencode
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
+	"sort"
 )
 
+// Marshaler is implemented by types that know how to encode themselves to
+// bencode. It is checked before the reflect-based struct/slice/map
+// encoding below, so a type can give, e.g., a fixed-size byte array like
+// an info-hash or peer-id a custom wire representation.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// Unmarshaler is the decoding counterpart of Marshaler.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
 func isPOD(k reflect.Kind) bool {
 	return k == reflect.Int64 || k == reflect.Uint64 || k == reflect.String
 }
 
+// isPODKind reports whether k is a Go kind that marshalPOD/unmarshalPOD
+// know how to turn into (or read from) a bencode int or string: any sized
+// int/uint, bool, or string. []byte is POD too, but it's a Slice and is
+// recognized separately by isByteSlice, since not every Slice is.
+func isPODKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Bool, reflect.String:
+		return true
+	}
+	return false
+}
+
+func isByteSlice(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8
+}
+
 func isRawMessagePtr(typ reflect.Type) bool {
 	return typ.Kind() == reflect.Ptr && typ.Elem().Name() == "RawMessage"
 }
 
+func marshalerOf(val reflect.Value) (Marshaler, bool) {
+	if val.CanAddr() {
+		if m, ok := val.Addr().Interface().(Marshaler); ok {
+			return m, true
+		}
+	}
+	if val.CanInterface() {
+		if m, ok := val.Interface().(Marshaler); ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+func unmarshalerOf(val reflect.Value) (Unmarshaler, bool) {
+	if !val.CanAddr() {
+		return nil, false
+	}
+	u, ok := val.Addr().Interface().(Unmarshaler)
+	return u, ok
+}
+
 func unmarshalPOD(pod interface{}, val reflect.Value) error {
 	podk := reflect.TypeOf(pod).Kind()
 	if !isPOD(podk) {
@@ -25,16 +80,97 @@ func unmarshalPOD(pod interface{}, val reflect.Value) error {
 
 	v := val.Elem()
 	k := v.Type().Kind()
-	if k == reflect.Int64 &&  podk == reflect.Uint64 {
-		v.Set(reflect.ValueOf(int64(pod.(uint64))))
+
+	switch {
+	case k == reflect.Bool && (podk == reflect.Int64 || podk == reflect.Uint64):
+		v.SetBool(podToInt64(pod) != 0)
+		return nil
+
+	case (k == reflect.Int || k == reflect.Int8 || k == reflect.Int16 || k == reflect.Int32 || k == reflect.Int64) &&
+		(podk == reflect.Int64 || podk == reflect.Uint64):
+		v.SetInt(podToInt64(pod))
+		return nil
+
+	case (k == reflect.Uint || k == reflect.Uint8 || k == reflect.Uint16 || k == reflect.Uint32 || k == reflect.Uint64) &&
+		podk == reflect.Uint64:
+		v.SetUint(pod.(uint64))
+		return nil
+
+	case isByteSlice(v.Type()) && podk == reflect.String:
+		v.SetBytes([]byte(pod.(string)))
+		return nil
+
+	case k == reflect.String && podk == reflect.String:
+		v.SetString(pod.(string))
 		return nil
 	}
 
-	if podk != k {
-		return fmt.Errorf("mismatched type got: %v want: %v", k, podk)
+	return fmt.Errorf("mismatched type got: %v want: %v", k, podk)
+}
+
+func podToInt64(pod interface{}) int64 {
+	if u, ok := pod.(uint64); ok {
+		return int64(u)
+	}
+	return pod.(int64)
+}
+
+// unmarshalInto decodes rm into v, which must be addressable. It is the
+// single place that decides, for any value position (a struct field, a
+// slice element, or a map value), whether rm is a custom type, a native
+// Go value (for an interface{} destination), a POD, a list, or a dict.
+func unmarshalInto(rm *RawMessage, v reflect.Value) error {
+	if u, ok := unmarshalerOf(v); ok {
+		buf := &bytes.Buffer{}
+		Encode(rm, buf)
+		return u.UnmarshalBencode(buf.Bytes())
 	}
 
-	v.Set(reflect.ValueOf(pod))
+	switch {
+	case v.Kind() == reflect.Interface:
+		if nv := nativeValue(rm); nv != nil {
+			v.Set(reflect.ValueOf(nv))
+		}
+		return nil
+	case isRawMessagePtr(v.Type()):
+		v.Set(reflect.ValueOf(rm))
+		return nil
+	case rm.POD != nil:
+		return unmarshalPOD(rm.POD, v.Addr())
+	case len(rm.L) > 0:
+		return unmarshalList(rm.L, v)
+	case len(rm.D) > 0:
+		if v.Kind() == reflect.Map {
+			v.Set(reflect.MakeMap(v.Type()))
+		} else {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return unmarshalDict(rm.D, v)
+	}
+	return nil
+}
+
+// nativeValue converts rm to a plain Go value with no bencode-specific
+// types, for unmarshaling into an interface{} destination (e.g. an
+// extension dict of unknown shape): map[string]interface{} for dicts,
+// []interface{} for lists, and the POD itself otherwise.
+func nativeValue(rm *RawMessage) interface{} {
+	switch {
+	case rm.POD != nil:
+		return rm.POD
+	case len(rm.L) > 0:
+		l := make([]interface{}, len(rm.L))
+		for i, e := range rm.L {
+			l[i] = nativeValue(e)
+		}
+		return l
+	case len(rm.D) > 0:
+		m := make(map[string]interface{}, len(rm.D))
+		for _, kv := range rm.D {
+			m[kv.K] = nativeValue(kv.V)
+		}
+		return m
+	}
 	return nil
 }
 
@@ -45,82 +181,50 @@ func unmarshalList(l []*RawMessage, v reflect.Value) (err error) {
 	}
 
 	elem := typ.Elem()
-	for i, rm := range l {
-		v.Set(reflect.Append(v, reflect.Zero(elem)))
-		val := v.Index(i)
-		switch {
-		case isRawMessagePtr(elem):
-			val.Set(reflect.ValueOf(rm))
-		case rm.POD != nil:
-			err = unmarshalPOD(rm.POD, val.Addr())
-		case len(rm.L) > 0:
-			err = unmarshalList(rm.L, val)
-		case len(rm.D) > 0:
-			val.Set(reflect.New(elem.Elem()))
-			err = unmarshalDict(rm.D, val)
-		}
-		if err != nil {
-			return
+	v.Set(reflect.MakeSlice(typ, 0, len(l)))
+	for _, rm := range l {
+		nv := reflect.New(elem).Elem()
+		if err := unmarshalInto(rm, nv); err != nil {
+			return err
 		}
+		v.Set(reflect.Append(v, nv))
 	}
-	return
+	return nil
 }
 
 func unmarshalDict(d []*KV, val reflect.Value) (err error) {
 	kind := val.Type().Kind()
-	if  kind != reflect.Ptr && kind != reflect.Map {
+	if kind != reflect.Ptr && kind != reflect.Map {
 		return fmt.Errorf("not a Ptr/Map: %v", kind)
 	}
 
-	fields := map[string]reflect.Value{}
-	if kind == reflect.Ptr {
-		v := val.Elem()
-		typ := v.Type()
-		if typ.Kind() != reflect.Struct {
-			return fmt.Errorf("not a Struct: %v", typ.Kind())
+	if kind == reflect.Map {
+		if val.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("map key must be string, got: %v", val.Type().Key().Kind())
 		}
-
-		for i := 0; i < typ.NumField(); i++ {
-			field := typ.Field(i)
-			if len(field.PkgPath) > 0 {
-				continue // unexported
-			}
-
-			key := field.Name
-			if len(field.Tag) > 0 {
-				tag := field.Tag.Get("ben")
-				if len(tag) > 0 {
-					key = tag
-				}
+		for _, kv := range d {
+			ev := reflect.New(val.Type().Elem()).Elem()
+			if err := unmarshalInto(kv.V, ev); err != nil {
+				return fmt.Errorf("field: %q: %v", kv.K, err)
 			}
-			fields[key] = v.Field(i)
+			val.SetMapIndex(reflect.ValueOf(kv.K), ev)
 		}
+		return nil
+	}
+
+	typ := val.Elem().Type()
+	if typ.Kind() != reflect.Struct {
+		return fmt.Errorf("not a Struct: %v", typ.Kind())
 	}
+	tc := codecFor(typ)
+	ptr := val.UnsafePointer()
 
 	for _, kv := range d {
-		var field reflect.Value
-		field, ok := fields[kv.K]
+		fc, ok := tc.byKey[kv.K]
 		if !ok {
 			continue
 		}
-
-		rm := kv.V
-		switch {
-		case isRawMessagePtr(field.Type()):
-			field.Set(reflect.ValueOf(rm))
-		case rm.POD != nil:
-			err = unmarshalPOD(rm.POD, field.Addr())
-		case len(rm.L) > 0:
-			err = unmarshalList(rm.L, field)
-		case len(rm.D) > 0:
-			if field.Type().Kind() == reflect.Map {
-				field.Set(reflect.MakeMap(field.Type()))
-			} else {
-				field.Set(reflect.New(field.Type().Elem()))
-			}
-			err = unmarshalDict(rm.D, field)
-		}
-		if err != nil {
+		if err := fc.decode(ptr, kv.V); err != nil {
 			return fmt.Errorf("field: %q: %v", kv.K, err)
 		}
 	}
@@ -128,15 +232,74 @@ func unmarshalDict(d []*KV, val reflect.Value) (err error) {
 }
 
 func marshalPOD(val reflect.Value) (rm *RawMessage) {
-	if reflect.DeepEqual(val.Interface(), reflect.Zero(val.Type()).Interface()) {
+	if isByteSlice(val.Type()) {
+		if val.Len() == 0 {
+			return nil
+		}
+	} else if reflect.DeepEqual(val.Interface(), reflect.Zero(val.Type()).Interface()) {
 		return nil
 	}
 
-	rm = &RawMessage{}
-	rm.POD = val.Interface()
+	rm = &RawMessage{POD: podValue(val)}
 	return
 }
 
+// podValue normalizes val, which must satisfy isPODKind or isByteSlice,
+// to the canonical RawMessage.POD representation also produced by
+// decoding: int64, uint64, or string.
+func podValue(val reflect.Value) interface{} {
+	switch {
+	case isByteSlice(val.Type()):
+		return string(val.Bytes())
+	case val.Kind() == reflect.Bool:
+		if val.Bool() {
+			return uint64(1)
+		}
+		return uint64(0)
+	case val.Kind() == reflect.String:
+		return val.String()
+	case val.Kind() == reflect.Int, val.Kind() == reflect.Int8, val.Kind() == reflect.Int16,
+		val.Kind() == reflect.Int32, val.Kind() == reflect.Int64:
+		return val.Int()
+	default:
+		return val.Uint()
+	}
+}
+
+// marshalValue encodes val, which may be a struct field, a slice
+// element, or a map value, trying a Marshaler first and falling back to
+// the reflect-based POD/list/map/dict encoders.
+func marshalValue(val reflect.Value) (*RawMessage, error) {
+	if val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return nil, nil
+		}
+		return marshalValue(val.Elem())
+	}
+
+	if m, ok := marshalerOf(val); ok {
+		bs, err := m.MarshalBencode()
+		if err != nil {
+			return nil, err
+		}
+		return Decode(bytes.NewReader(bs))
+	}
+
+	switch {
+	case isByteSlice(val.Type()):
+		return marshalPOD(val), nil
+	case isPODKind(val.Kind()):
+		return marshalPOD(val), nil
+	case val.Kind() == reflect.Slice:
+		return marshalList(val)
+	case val.Kind() == reflect.Map:
+		return marshalMap(val)
+	case val.Kind() == reflect.Ptr:
+		return marshalDict(val)
+	}
+	return nil, nil
+}
+
 func marshalList(val reflect.Value) (rm *RawMessage, err error) {
 	if val.Len() == 0 {
 		return nil, nil
@@ -145,16 +308,7 @@ func marshalList(val reflect.Value) (rm *RawMessage, err error) {
 	rm = &RawMessage{}
 	rm.L = []*RawMessage{}
 	for i := 0; i < val.Len(); i++ {
-		var m *RawMessage
-		kind := val.Type().Elem().Kind()
-		switch kind {
-		case reflect.Int64, reflect.Uint64, reflect.String:
-			m = marshalPOD(val.Index(i))
-		case reflect.Slice:
-			m, err = marshalList(val.Index(i))
-		case reflect.Ptr:
-			m, err = marshalDict(val.Index(i))
-		}
+		m, err := marshalValue(val.Index(i))
 		if err != nil {
 			return nil, err
 		}
@@ -165,6 +319,35 @@ func marshalList(val reflect.Value) (rm *RawMessage, err error) {
 	return
 }
 
+// marshalMap encodes a map[string]T, sorting its keys into raw-byte
+// lexicographic order per BEP-3.
+func marshalMap(val reflect.Value) (rm *RawMessage, err error) {
+	if val.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("map key must be string, got: %v", val.Type().Key().Kind())
+	}
+	if val.Len() == 0 {
+		return nil, nil
+	}
+
+	keys := val.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	rm = &RawMessage{}
+	for _, k := range keys {
+		v, err := marshalValue(val.MapIndex(k))
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			rm.D = append(rm.D, &KV{K: k.String(), V: v})
+		}
+	}
+	if len(rm.D) == 0 {
+		return nil, nil
+	}
+	return rm, nil
+}
+
 func marshalDict(val reflect.Value) (rm *RawMessage, err error) {
 	v := val.Elem()
 	typ := v.Type()
@@ -176,30 +359,13 @@ func marshalDict(val reflect.Value) (rm *RawMessage, err error) {
 		return val.Interface().(*RawMessage), nil
 	}
 
-	rm = &RawMessage{}
-	for i := 0; i < typ.NumField(); i++ {
-		field := typ.Field(i)
-		if len(field.PkgPath) > 0 {
-			continue // unexported
-		}
-
-		key := field.Name
-		if len(field.Tag) > 0 {
-			tag := field.Tag.Get("ben")
-			if len(tag) > 0 {
-				key = tag
-			}
-		}
+	tc := codecFor(typ)
+	ptr := val.UnsafePointer()
 
-		kv := &KV{K: key}
-		switch field.Type.Kind() {
-		case reflect.Int64, reflect.Uint64, reflect.String:
-			kv.V = marshalPOD(v.Field(i))
-		case reflect.Slice:
-			kv.V, err = marshalList(v.Field(i))
-		case reflect.Ptr:
-			kv.V, err = marshalDict(v.Field(i))
-		}
+	rm = &RawMessage{}
+	for _, fc := range tc.fields {
+		kv := &KV{K: fc.key}
+		kv.V, err = fc.encode(ptr)
 		if err != nil {
 			return nil, err
 		}
@@ -207,5 +373,6 @@ func marshalDict(val reflect.Value) (rm *RawMessage, err error) {
 			rm.D = append(rm.D, kv)
 		}
 	}
+	// tc.fields is already sorted by key, so rm.D comes out in BEP-3 order.
 	return rm, nil
 }
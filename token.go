@@ -0,0 +1,154 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bencode
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Token is a single lexical token returned by Decoder.Token: a Delim
+// (DictStart, DictEnd, ListStart, ListEnd), an int64 or uint64, or a
+// string.
+type Token interface{}
+
+// Delim is a bencode structural delimiter: the start or end of a dict or
+// list, as returned by Decoder.Token.
+type Delim int
+
+const (
+	DictStart Delim = iota
+	DictEnd
+	ListStart
+	ListEnd
+)
+
+func (d Delim) String() string {
+	switch d {
+	case DictStart:
+		return "d"
+	case DictEnd, ListEnd:
+		return "e"
+	case ListStart:
+		return "l"
+	}
+	return "?"
+}
+
+// Token returns the next lexical token in the input: a Delim, an int64 or
+// uint64, or a string. Unlike Decode, Token never materializes a value's
+// children, so it can be used to walk a large bencoded document (such as a
+// multi-megabyte torrent) without buffering all of it. Large byte strings
+// should be read with RawStringReader instead of Token, to avoid buffering
+// them in memory; nested dicts and lists should be consumed with repeated
+// Token calls or dropped with Skip.
+func (d *Decoder) Token() (Token, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c >= '0' && c <= '9':
+		if err := d.r.UnreadByte(); err != nil {
+			return nil, err
+		}
+		return strBuf(d.r)
+
+	case c == 'i':
+		intbuf, err := intBuf(d.r, 'e')
+		if err != nil {
+			return nil, err
+		}
+		if intbuf[0] == '-' {
+			return strconv.ParseInt(intbuf, 0, 64)
+		}
+		return strconv.ParseUint(intbuf, 0, 64)
+
+	case c == 'd':
+		d.stack = append(d.stack, 'd')
+		return DictStart, nil
+
+	case c == 'l':
+		d.stack = append(d.stack, 'l')
+		return ListStart, nil
+
+	case c == 'e':
+		if len(d.stack) == 0 {
+			return nil, fmt.Errorf("bencode: unexpected 'e' with no open dict or list")
+		}
+		kind := d.stack[len(d.stack)-1]
+		d.stack = d.stack[:len(d.stack)-1]
+		if kind == 'd' {
+			return DictEnd, nil
+		}
+		return ListEnd, nil
+
+	default:
+		return nil, fmt.Errorf("bencode: unexpected character: '%v'", c)
+	}
+}
+
+// RawStringReader reads a bencode byte-string's length prefix and returns
+// an io.Reader over exactly its payload, without buffering the payload in
+// memory. Call it in place of Token wherever a string is expected (for
+// example, after reading the "pieces" key of a torrent's info dict). The
+// returned reader must be fully read before the Decoder is used again.
+func (d *Decoder) RawStringReader() (io.Reader, error) {
+	intbuf, err := intBuf(d.r, ':')
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := strconv.ParseUint(intbuf, 0, 64)
+	if err != nil {
+		return nil, err
+	}
+	return io.LimitReader(d.r, int64(l)), nil
+}
+
+// Skip drops the next value (a string, int, list, or dict, including all
+// of its children) from the input without materializing it. Byte-strings
+// are discarded by streaming directly to io.Discard, so Skip never
+// allocates proportionally to their length.
+func (d *Decoder) Skip() error {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c >= '0' && c <= '9':
+		if err := d.r.UnreadByte(); err != nil {
+			return err
+		}
+		r, err := d.RawStringReader()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.Discard, r)
+		return err
+
+	case c == 'i':
+		_, err := intBuf(d.r, 'e')
+		return err
+
+	case c == 'l' || c == 'd':
+		for {
+			if ok, err := isDelim(d.r, 'e'); err != nil {
+				return err
+			} else if ok {
+				return nil
+			}
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("bencode: unexpected character: '%v'", c)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package wal implements a CRC-framed, append-only log of bencoded
+// messages: harvested torrents, DHT get_peers responses, tracker
+// replies, and the like. Each record is a fixed 8-byte little-endian
+// header (a uint32 payload length, then a uint32 IEEE CRC-32 of the
+// payload) followed by the bencoded payload itself, so a reader can
+// detect corruption without an outer container format.
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"github.com/ranveerkunal/bencode"
+)
+
+// ErrCorrupt is returned by Reader.Read when a record's header claims an
+// implausible payload length, or its payload does not match its checksum.
+var ErrCorrupt = errors.New("wal: corrupt record")
+
+const headerSize = 8 // uint32 length + uint32 crc32
+
+// maxRecordSize bounds the payload length Read will believe out of a
+// record header. Without a cap, a single flipped bit in the length field
+// of an otherwise-corrupt record could claim a length up to 4GiB and
+// make Read allocate that much before the CRC check ever gets a chance
+// to reject it.
+const maxRecordSize = 64 << 20 // 64MiB
+
+// Writer appends bencoded messages to an io.Writer as CRC-framed records.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w}
+}
+
+// Write appends rm as a single framed record.
+func (w *Writer) Write(rm *bencode.RawMessage) error {
+	buf := &bytes.Buffer{}
+	bencode.Encode(rm, buf)
+	payload := buf.Bytes()
+
+	var hdr [headerSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(payload))
+
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(payload)
+	return err
+}
+
+// Reader reads the records a Writer produced, in order.
+type Reader struct {
+	r        io.Reader
+	truncate bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// SetTruncate enables or disables truncate mode. In truncate mode, Read
+// reports a clean io.EOF instead of an error when it finds a short or
+// corrupt trailing record, the common recovery pattern for an
+// append-only log whose last write may not have completed.
+func (r *Reader) SetTruncate(truncate bool) {
+	r.truncate = truncate
+}
+
+// Read returns the next record, or an error: io.EOF at a clean end of
+// the log, ErrCorrupt if a record's payload fails its checksum (unless
+// truncate mode is enabled, in which case Read returns io.EOF instead),
+// or an underlying I/O error.
+func (r *Reader) Read() (*bencode.RawMessage, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return nil, r.shortErr(err)
+	}
+
+	length := binary.LittleEndian.Uint32(hdr[0:4])
+	wantCRC := binary.LittleEndian.Uint32(hdr[4:8])
+
+	if length > maxRecordSize {
+		if r.truncate {
+			return nil, io.EOF
+		}
+		return nil, ErrCorrupt
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF // the header was read, so this record is short
+		}
+		return nil, r.shortErr(err)
+	}
+
+	if crc32.ChecksumIEEE(payload) != wantCRC {
+		if r.truncate {
+			return nil, io.EOF
+		}
+		return nil, ErrCorrupt
+	}
+
+	return bencode.Decode(bytes.NewReader(payload))
+}
+
+func (r *Reader) shortErr(err error) error {
+	if r.truncate && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		return io.EOF
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/ranveerkunal/bencode"
+)
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+
+	want := []*bencode.RawMessage{
+		{POD: uint64(1)},
+		{POD: "hello"},
+		{D: []*bencode.KV{{K: "a", V: &bencode.RawMessage{POD: uint64(2)}}}},
+	}
+	for _, rm := range want {
+		if err := w.Write(rm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewReader(buf)
+	for i, rm := range want {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if got.String() != rm.String() {
+			t.Fatalf("record %d: got %v want %v", i, got, rm)
+		}
+	}
+
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("got: %v, want: io.EOF", err)
+	}
+}
+
+func TestReadDetectsCorruption(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	if err := w.Write(&bencode.RawMessage{POD: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := buf.Bytes()
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	r := NewReader(bytes.NewReader(corrupt))
+	if _, err := r.Read(); err != ErrCorrupt {
+		t.Fatalf("got: %v, want: %v", err, ErrCorrupt)
+	}
+}
+
+func TestReadRejectsOversizedLengthWithoutAllocating(t *testing.T) {
+	var hdr [headerSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], maxRecordSize+1)
+	binary.LittleEndian.PutUint32(hdr[4:8], 0)
+
+	r := NewReader(bytes.NewReader(hdr[:]))
+	if _, err := r.Read(); err != ErrCorrupt {
+		t.Fatalf("got: %v, want: %v", err, ErrCorrupt)
+	}
+}
+
+func TestReadTruncateStopsCleanlyOnShortRecord(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	if err := w.Write(&bencode.RawMessage{POD: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&bencode.RawMessage{POD: "world"}); err != nil {
+		t.Fatal(err)
+	}
+
+	full := buf.Bytes()
+	truncated := full[:len(full)-3] // cut the last record short
+
+	r := NewReader(bytes.NewReader(truncated))
+	r.SetTruncate(true)
+
+	if _, err := r.Read(); err != nil {
+		t.Fatalf("first record: %v", err)
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("second (short) record: got %v, want io.EOF", err)
+	}
+}